@@ -1,373 +1,1176 @@
-package main
-
-import (
-	"bufio"
-	b64 "encoding/base64"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"net/url"
-	"os"
-	"os/exec"
-	"regexp"
-	"strings"
-	"time"
-
-	. "github.com/gagliardetto/utilz"
-	"github.com/slack-go/slack"
-	"github.com/urfave/cli/v2"
-)
-
-// main func
-func main() {
-	var displayToken string
-	var isDebug bool
-	var noStdout bool
-	var noStderr bool
-	var charLimit int
-
-	// urfave/cli declaration
-	app := &cli.App{
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "config",
-				Aliases:     []string{"c"},
-				Value:       "config.json",
-				Usage:       "Path to configuration `FILE`",
-				EnvVars:     []string{"slack-shell-config"},
-			},
-			&cli.BoolFlag{
-				Name:        "displayUnredacted",
-				Aliases:     []string{"dU"},
-				Value:       false,
-				Usage:       "Display Slack Token unredacted (Otherwise make sure it is loaded)",
-				EnvVars:     []string{"slack-shell-config"},
-			},
-			&cli.DurationFlag{
-				Name:        "wait",
-				Aliases:     []string{"w"},
-				Value:       5 * time.Second,
-				Usage:       "Wait duration between requests.",
-			},
-			&cli.BoolFlag{
-				Name:        "debug",
-				Aliases:     []string{"d"},
-				Value:       false,
-				Usage:       "Debug mode",
-				Destination: &isDebug,
-			},
-			&cli.BoolFlag{
-				Name:        "noStdout",
-				Aliases:     []string{"nO"},
-				Value:       false,
-				Usage:       "Do not receive StdOut.",
-				Destination: &noStdout,
-			},
-			&cli.BoolFlag{
-				Name:        "noStderr",
-				Aliases:     []string{"nE"},
-				Value:       false,
-				Usage:       "Do not receive StdErr",
-				Destination: &noStderr,
-			},
-			&cli.IntFlag{
-				Name:        "char-limit",
-				Aliases:     []string{"cl"},
-				Value:       3000,
-				Usage:       "Limit of messages' length `INT`",
-				Destination: &charLimit,
-			},
-		},
-		Action: func(c *cli.Context) error {
-			Infof("Using %s as config file...", c.String("c"))
-
-			conf, err := LoadConfigFromFile(c.String("c"))
-			if err != nil {
-				panic(err)
-			}
-
-			// validate and change struct name if more fields needed
-
-			if !c.Bool("displayUnredacted") {
-				displayToken = GetRedacted(conf.SlackToken)
-			} else {
-				displayToken = conf.SlackToken
-			}
-			Infof("Using %s as Slack Token", displayToken)
-
-			if noStdout && noStderr {
-				panic(
-					fmt.Errorf("Cannot set noStdout and noStderr at the same time."),
-				)
-			}
-
-			api := slack.New(conf.SlackToken)
-			rtm := api.NewRTM()
-
-			go rtm.ManageConnection()
-
-			for msg := range rtm.IncomingEvents {
-				switch ev := msg.Data.(type) {
-
-				case *slack.DesktopNotificationEvent:
-					// set as argument not to access the global variable
-					go func(ev *slack.DesktopNotificationEvent) {
-						fmt.Printf("Desktop Notification: %v\n", ev)
-
-						command, readableCommand, err := ParseMessage(ev.Content)
-						if err != nil {
-							panic(err)
-						}
-
-						// create thread
-						threadTimestamp, err := SlackNewThread(
-							rtm,
-							ev.Channel,
-							fmt.Sprintf("Executing: %s", readableCommand),
-						)
-						if err != nil {
-							panic(err)
-						}
-
-						var toSend string
-
-						splitCommand := strings.Split(command, " ")
-						cmd := exec.Command(
-							splitCommand[0], splitCommand[1:]...,
-						)
-
-						// Sync stdout and stderr (Not to mess up the order)
-						stdoutFinished := true
-						if !noStdout {
-							stdout, err := cmd.StdoutPipe()
-							stdoutFinished = false
-							if err != nil {
-								log.Fatal(err)
-							}
-
-							go func() {
-								buf := bufio.NewReader(stdout)
-								for {
-									line, _, err := buf.ReadLine()
-									if err != nil {
-										break
-									}
-									toSend += string(line) + "\n"
-									if isDebug {
-										fmt.Println(len(line))
-									}
-								}
-								stdoutFinished = true
-							}()
-						}
-
-						stderrFinished := true
-						if !noStderr {
-							stderr, err := cmd.StderrPipe()
-							stderrFinished = false
-							if err != nil {
-								log.Fatal(err)
-							}
-
-							go func() {
-								buf := bufio.NewReader(stderr)
-								for {
-									line, _, err := buf.ReadLine()
-									if err != nil {
-										break
-									}
-									toSend += string(line) + "\n"
-									if isDebug {
-										fmt.Println(len(line))
-									}
-								}
-								stderrFinished = true
-							}()
-						}
-
-						// must cmd.Start() *after* Std(out|err)Pipe()
-						err = cmd.Start()
-						if err != nil {
-							panic(err)
-						}
-
-						// first reply
-						msgTimestamp, err := SlackNewReply(rtm, ev.Channel, threadTimestamp, "Output is coming :P")
-						if err != nil {
-							panic(err)
-						}
-						time.Sleep(c.Duration("w"))
-
-						index := 0
-						needsNewReply := false
-						hasFinished := false
-						for {
-							now := toSend // avoid goroutines pollution through execution
-							if len(now) > charLimit*(index+1) && !needsNewReply {
-								_, err = SlackUpdateMessage(rtm,
-									ev.Channel,
-									msgTimestamp,
-									toSend[charLimit*index:charLimit*(index+1)],
-								)
-								index += 1
-								needsNewReply = true
-								if err != nil {
-									panic(err)
-								}
-							} else {
-								if needsNewReply {
-									if len(now) > charLimit*(index+1) {
-										msgTimestamp, err = SlackNewReply(rtm,
-											ev.Channel,
-											threadTimestamp,
-											now[charLimit*index:charLimit*(index+1)],
-										)
-										index += 1
-									} else {
-										msgTimestamp, err = SlackNewReply(rtm,
-											ev.Channel,
-											threadTimestamp,
-											now[charLimit*index:len(now)-1],
-										)
-										needsNewReply = false
-									}
-									if err != nil {
-										panic(err)
-									}
-								} else {
-									_, err = SlackUpdateMessage(rtm,
-										ev.Channel,
-										msgTimestamp,
-										now[charLimit*index:len(now)-1],
-									)
-									if err != nil {
-										panic(err)
-									}
-								}
-							}
-
-							// make sure loop is redone and all the output is sent
-							if hasFinished && !needsNewReply {
-								Infof("%s finished", readableCommand)
-								break
-							}
-							if stdoutFinished && stderrFinished {
-								hasFinished = true
-							}
-
-							time.Sleep(c.Duration("w"))
-						}
-
-					}(ev)
-
-				case *slack.RTMError:
-					fmt.Printf("Error: %s\n", ev.Error())
-
-				case *slack.InvalidAuthEvent:
-					fmt.Printf("Invalid credentials")
-					return nil
-
-				default:
-					if isDebug {
-						fmt.Printf("Unexpected: %v\n%s\n", msg.Data, ev)
-					}
-				}
-			}
-
-			return nil
-		},
-	}
-
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func SlackNewThread(rtm *slack.RTM, channel, message string) (string, error) {
-	_, threadTimestamp, err := rtm.PostMessage(channel, slack.MsgOptionText(message, false))
-
-	if err != nil {
-		return "", err
-	}
-	return threadTimestamp, nil
-}
-
-func SlackNewReply(rtm *slack.RTM, channel, threadTimestamp, message string) (string, error) {
-	_, msgTimestamp, err := rtm.PostMessage(channel, slack.MsgOptionTS(threadTimestamp), slack.MsgOptionText(message, false))
-
-	if err != nil {
-		return "", err
-	}
-	return msgTimestamp, nil
-}
-
-func SlackUpdateMessage(rtm *slack.RTM, channel, msgTimestamp, message string) (string, error) {
-	_, _, _, err := rtm.UpdateMessage(channel, msgTimestamp, slack.MsgOptionText(message, false))
-
-	if err != nil {
-		return "", err
-	}
-	return msgTimestamp, nil
-}
-
-// utils
-type TokenFileConfig struct {
-	SlackToken string `json:"slack-token"`
-}
-
-func LoadConfigFromFile(filepath string) (*TokenFileConfig, error) {
-	jsonFile, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		return nil, fmt.Errorf("error while reading config file from %q: %s", filepath, err)
-	}
-
-	var conf TokenFileConfig
-	err = json.Unmarshal(jsonFile, &conf)
-	if err != nil {
-		return nil, fmt.Errorf("error while unmarshaling config file: %s", err)
-	}
-
-	return &conf, nil
-}
-
-func GetRedacted(unRedactedToken string) string {
-	// redact any letter & digit
-	pattern := regexp.MustCompile(`[A-Za-z0-9]`)
-	return pattern.ReplaceAllString(unRedactedToken, "X")
-}
-
-func ParseMessage(message string) (string, string, error) {
-	// jorgectf: @slackshellapp this is a command
-
-	// https://api.slack.com/reference/surfaces/formatting#escaping
-	message = strings.ReplaceAll(message, "&amp;", "&")
-	message = strings.ReplaceAll(message, "&lt;", "<")
-	message = strings.ReplaceAll(message, "&gt;", ">")
-
-	// copy-pasting from slack -> jorgectf: @slackshellapp%C2%A0this
-	urlEncodedMessage := url.QueryEscape(message)
-	if strings.Contains(urlEncodedMessage, "%C2%A0") {
-		message, _ = url.QueryUnescape(
-			strings.ReplaceAll(urlEncodedMessage, "%C2%A0", "+"),
-		)
-	}
-
-	// get "this is a command"
-	message = strings.Join(
-		// get [this is a command]
-		strings.Split(message, " ")[2:],
-		" ",
-	)
-	if message == "" {
-		return "", "", fmt.Errorf("Empty command received. %s", message)
-	}
-
-	// convert to base64
-	command := b64.StdEncoding.EncodeToString([]byte(message))
-	// http://www.jackson-t.ca/runtime-exec-payloads.html
-	command = fmt.Sprintf("bash -c {echo,%s}|{base64,-d}|bash", command)
-
-	return command, message, nil
-}
+package main
+
+import (
+	"bufio"
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/gagliardetto/utilz"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+	"github.com/urfave/cli/v2"
+)
+
+// main func
+func main() {
+	var displayToken string
+	var isDebug bool
+	var noStdout bool
+	var noStderr bool
+	var charLimit int
+	var forceUploadFlag bool
+	var uploadThreshold int
+	var lineIncludesFlag string
+	var lineExcludesFlag string
+
+	// urfave/cli declaration
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "config",
+				Aliases:     []string{"c"},
+				Value:       "config.json",
+				Usage:       "Path to configuration `FILE`",
+				EnvVars:     []string{"slack-shell-config"},
+			},
+			&cli.BoolFlag{
+				Name:        "displayUnredacted",
+				Aliases:     []string{"dU"},
+				Value:       false,
+				Usage:       "Display Slack Token unredacted (Otherwise make sure it is loaded)",
+				EnvVars:     []string{"slack-shell-config"},
+			},
+			&cli.DurationFlag{
+				Name:        "wait",
+				Aliases:     []string{"w"},
+				Value:       5 * time.Second,
+				Usage:       "Wait duration between requests.",
+			},
+			&cli.BoolFlag{
+				Name:        "debug",
+				Aliases:     []string{"d"},
+				Value:       false,
+				Usage:       "Debug mode",
+				Destination: &isDebug,
+			},
+			&cli.BoolFlag{
+				Name:        "noStdout",
+				Aliases:     []string{"nO"},
+				Value:       false,
+				Usage:       "Do not receive StdOut.",
+				Destination: &noStdout,
+			},
+			&cli.BoolFlag{
+				Name:        "noStderr",
+				Aliases:     []string{"nE"},
+				Value:       false,
+				Usage:       "Do not receive StdErr",
+				Destination: &noStderr,
+			},
+			&cli.IntFlag{
+				Name:        "char-limit",
+				Aliases:     []string{"cl"},
+				Value:       3000,
+				Usage:       "Limit of messages' length `INT`",
+				Destination: &charLimit,
+			},
+			&cli.BoolFlag{
+				Name:        "upload",
+				Value:       false,
+				Usage:       "Always post command output as a file upload instead of chunked replies",
+				Destination: &forceUploadFlag,
+			},
+			&cli.IntFlag{
+				Name:        "upload-threshold",
+				Value:       10000,
+				Usage:       "Total output size in bytes above which output is uploaded as a file `INT`",
+				Destination: &uploadThreshold,
+			},
+			&cli.StringFlag{
+				Name:        "line-includes",
+				Usage:       "Default regex: only forward output lines matching it to Slack `REGEX`",
+				Destination: &lineIncludesFlag,
+			},
+			&cli.StringFlag{
+				Name:        "line-excludes",
+				Usage:       "Default regex: drop output lines matching it before forwarding to Slack `REGEX`",
+				Destination: &lineExcludesFlag,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			Infof("Using %s as config file...", c.String("c"))
+
+			conf, err := LoadConfigFromFile(c.String("c"))
+			if err != nil {
+				panic(err)
+			}
+
+			// validate and change struct name if more fields needed
+
+			if !c.Bool("displayUnredacted") {
+				displayToken = GetRedacted(conf.SlackToken)
+			} else {
+				displayToken = conf.SlackToken
+			}
+			Infof("Using %s as Slack Token", displayToken)
+
+			if conf.AppToken == "" {
+				panic(fmt.Errorf("config is missing app-token, required for Socket Mode"))
+			}
+
+			if noStdout && noStderr {
+				panic(
+					fmt.Errorf("Cannot set noStdout and noStderr at the same time."),
+				)
+			}
+
+			dangerousPatterns, err := CompileDangerousPatterns(conf.DangerousPatterns)
+			if err != nil {
+				panic(err)
+			}
+
+			defaultIncludeRegex, err := compileOptionalPattern(lineIncludesFlag)
+			if err != nil {
+				panic(err)
+			}
+			defaultExcludeRegex, err := compileOptionalPattern(lineExcludesFlag)
+			if err != nil {
+				panic(err)
+			}
+
+			api := slack.New(
+				conf.SlackToken,
+				slack.OptionDebug(isDebug),
+				slack.OptionAppLevelToken(conf.AppToken),
+			)
+			client := socketmode.New(
+				api,
+				socketmode.OptionDebug(isDebug),
+			)
+
+			// handlers are tried in order for each incoming command; the
+			// ShellHandler catch-all must stay last.
+			handlers := []CommandHandler{
+				&HelpHandler{},
+				&PsHandler{},
+				&KillHandler{},
+				&CdHandler{},
+				&ShellHandler{
+					NoStdout:        noStdout,
+					NoStderr:        noStderr,
+					CharLimit:       charLimit,
+					ForceUpload:     forceUploadFlag,
+					UploadThreshold: uploadThreshold,
+					IsDebug:         isDebug,
+				},
+			}
+
+			handleCommand := func(channel, user, text string) {
+				fmt.Printf("Dispatching command from channel %s: %s\n", channel, text)
+
+				text, forceUpload := stripUploadSuffix(text)
+				text, includeRaw, excludeRaw := stripLineFilterSuffixes(text)
+
+				includeRegex := defaultIncludeRegex
+				if includeRaw != "" {
+					re, compileErr := regexp.Compile(includeRaw)
+					if compileErr != nil {
+						if _, postErr := SlackNewThread(
+							api,
+							channel,
+							fmt.Sprintf("Invalid grep-in pattern %q: %s", includeRaw, compileErr),
+						); postErr != nil {
+							Infof("failed to post grep-in parse error: %s", postErr)
+						}
+						return
+					}
+					includeRegex = re
+				}
+
+				excludeRegex := defaultExcludeRegex
+				if excludeRaw != "" {
+					re, compileErr := regexp.Compile(excludeRaw)
+					if compileErr != nil {
+						if _, postErr := SlackNewThread(
+							api,
+							channel,
+							fmt.Sprintf("Invalid grep-out pattern %q: %s", excludeRaw, compileErr),
+						); postErr != nil {
+							Infof("failed to post grep-out parse error: %s", postErr)
+						}
+						return
+					}
+					excludeRegex = re
+				}
+
+				command, readableCommand, err := ParseMessage(text)
+				if err != nil {
+					panic(err)
+				}
+
+				if allowed, reason := conf.Authorization.Allow(user, channel, readableCommand); !allowed {
+					AuditLog(false, user, channel, readableCommand, reason)
+					if _, err := SlackNewThread(
+						api,
+						channel,
+						fmt.Sprintf("Denied: %s", reason),
+					); err != nil {
+						Infof("failed to post denial notice for %q: %s", readableCommand, err)
+					}
+					return
+				}
+				AuditLog(true, user, channel, readableCommand, "")
+
+				handler := matchHandler(handlers, readableCommand)
+
+				if _, isShell := handler.(*ShellHandler); isShell && isDangerous(dangerousPatterns, readableCommand) {
+					approved, err := ConfirmDangerousCommand(api, channel, user, readableCommand, command)
+					if err != nil {
+						AuditLog(false, user, channel, readableCommand, err.Error())
+						if _, postErr := SlackNewThread(
+							api,
+							channel,
+							fmt.Sprintf("Cancelled: %s", err),
+						); postErr != nil {
+							Infof("failed to post cancellation notice for %q: %s", readableCommand, postErr)
+						}
+						return
+					}
+					if !approved {
+						AuditLog(false, user, channel, readableCommand, "dangerous command not approved")
+						if _, err := SlackNewThread(
+							api,
+							channel,
+							fmt.Sprintf("Cancelled: %s was not approved", readableCommand),
+						); err != nil {
+							Infof("failed to post cancellation notice for %q: %s", readableCommand, err)
+						}
+						return
+					}
+				}
+
+				// create thread
+				threadTimestamp, err := SlackNewThread(
+					api,
+					channel,
+					fmt.Sprintf("Executing: %s", readableCommand),
+				)
+				if err != nil {
+					panic(err)
+				}
+
+				reply := func(message string) {
+					if _, err := SlackNewReply(api, channel, threadTimestamp, message); err != nil {
+						Infof("failed to post reply for %q: %s", readableCommand, err)
+					}
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				ctx = withExecState(ctx, execState{
+					API:             api,
+					Channel:         channel,
+					ThreadTimestamp: threadTimestamp,
+					Wait:            c.Duration("w"),
+					ForceUpload:     forceUpload,
+					IncludeRegex:    includeRegex,
+					ExcludeRegex:    excludeRegex,
+					RawCommand:      readableCommand,
+				})
+
+				if _, isShell := handler.(*ShellHandler); isShell {
+					jobID := registerJob(channel, readableCommand, cancel)
+					defer unregisterJob(jobID)
+				}
+
+				if err := handler.Execute(ctx, strings.Fields(readableCommand), reply); err != nil {
+					Infof("execution failed for %q: %s", readableCommand, err)
+					reply(fmt.Sprintf("Error: %s", err))
+				}
+			}
+
+			go func() {
+				for evt := range client.Events {
+					switch evt.Type {
+					case socketmode.EventTypeEventsAPI:
+						eventsAPIEvent, ok := evt.Data.(slackevents.EventsAPIEvent)
+						if !ok {
+							if isDebug {
+								fmt.Printf("Unexpected EventsAPI data: %v\n", evt.Data)
+							}
+							continue
+						}
+
+						client.Ack(*evt.Request)
+
+						if eventsAPIEvent.Type != slackevents.CallbackEvent {
+							continue
+						}
+
+						switch ev := eventsAPIEvent.InnerEvent.Data.(type) {
+						case *slackevents.AppMentionEvent:
+							// strip the leading "<@BOTID>" mention before parsing
+							text := mentionPattern.ReplaceAllString(ev.Text, "")
+							go handleCommand(ev.Channel, ev.User, text)
+
+						case *slackevents.MessageEvent:
+							if ev.ChannelType == "im" && ev.BotID == "" {
+								go handleCommand(ev.Channel, ev.User, ev.Text)
+							}
+						}
+
+					case socketmode.EventTypeInteractive:
+						callback, ok := evt.Data.(slack.InteractionCallback)
+						if !ok {
+							if isDebug {
+								fmt.Printf("Unexpected Interactive data: %v\n", evt.Data)
+							}
+							continue
+						}
+
+						client.Ack(*evt.Request)
+						go handleInteraction(callback)
+
+					case socketmode.EventTypeConnecting:
+						Infof("Connecting to Slack with Socket Mode...")
+
+					case socketmode.EventTypeConnectionError:
+						fmt.Printf("Connection failed: %v\n", evt.Data)
+
+					case socketmode.EventTypeInvalidAuth:
+						fmt.Printf("Invalid credentials")
+						os.Exit(1)
+
+					default:
+						if isDebug {
+							fmt.Printf("Unexpected: %v\n%v\n", evt.Type, evt.Data)
+						}
+					}
+				}
+			}()
+
+			return client.Run()
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// mentionPattern matches a Slack user mention such as "<@U0123ABCD>".
+var mentionPattern = regexp.MustCompile(`^<@[A-Z0-9]+>\s*`)
+
+// uploadSuffixPattern matches a trailing "> file" redirect used to force the
+// file-upload output sink for a single command.
+var uploadSuffixPattern = regexp.MustCompile(`\s*>\s*file\s*$`)
+
+// stripUploadSuffix removes a trailing "> file" suffix from text and reports
+// whether it was present.
+func stripUploadSuffix(text string) (string, bool) {
+	if !uploadSuffixPattern.MatchString(text) {
+		return text, false
+	}
+	return uploadSuffixPattern.ReplaceAllString(text, ""), true
+}
+
+// grepInSuffixPattern matches a trailing "| grep-in /pattern/" suffix used
+// to only forward matching output lines to Slack for a single command.
+var grepInSuffixPattern = regexp.MustCompile(`\s*\|\s*grep-in\s*/([^/]*)/\s*$`)
+
+// grepOutSuffixPattern matches a trailing "| grep-out /pattern/" suffix
+// used to drop matching output lines before they reach Slack for a single
+// command.
+var grepOutSuffixPattern = regexp.MustCompile(`\s*\|\s*grep-out\s*/([^/]*)/\s*$`)
+
+// stripLineFilterSuffixes removes trailing "| grep-in /pattern/" and
+// "| grep-out /pattern/" suffixes, in either order, from text. It returns
+// the cleaned text along with the raw include/exclude patterns found, if
+// any; a raw pattern is empty when that suffix was not present.
+func stripLineFilterSuffixes(text string) (cleaned, include, exclude string) {
+	cleaned = text
+	for {
+		if include == "" {
+			if m := grepInSuffixPattern.FindStringSubmatch(cleaned); m != nil {
+				include = m[1]
+				cleaned = grepInSuffixPattern.ReplaceAllString(cleaned, "")
+				continue
+			}
+		}
+		if exclude == "" {
+			if m := grepOutSuffixPattern.FindStringSubmatch(cleaned); m != nil {
+				exclude = m[1]
+				cleaned = grepOutSuffixPattern.ReplaceAllString(cleaned, "")
+				continue
+			}
+		}
+		break
+	}
+	return cleaned, include, exclude
+}
+
+// compileOptionalPattern compiles pattern, returning a nil *regexp.Regexp
+// (no filter: every line passes) when pattern is empty.
+func compileOptionalPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// filenamePattern matches any character not safe to use unescaped in a
+// Slack file upload's filename.
+var filenamePattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// UploadCommandOutput posts stdout and stderr as separate snippet file
+// attachments in the given thread via the files.upload v2 flow, used for
+// commands whose output is too large for chunked replies.
+func UploadCommandOutput(api *slack.Client, channel, threadTimestamp, readableCommand, stdoutBuf, stderrBuf string) error {
+	base := filenamePattern.ReplaceAllString(readableCommand, "_")
+	if len(base) > 32 {
+		base = base[:32]
+	}
+
+	if stdoutBuf != "" {
+		_, err := api.UploadFileV2(slack.UploadFileV2Parameters{
+			Channel:         channel,
+			ThreadTimestamp: threadTimestamp,
+			Filename:        base + ".stdout.txt",
+			FileSize:        len(stdoutBuf),
+			Content:         stdoutBuf,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if stderrBuf != "" {
+		_, err := api.UploadFileV2(slack.UploadFileV2Parameters{
+			Channel:         channel,
+			ThreadTimestamp: threadTimestamp,
+			Filename:        base + ".stderr.txt",
+			FileSize:        len(stderrBuf),
+			Content:         stderrBuf,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func SlackNewThread(api *slack.Client, channel, message string) (string, error) {
+	_, threadTimestamp, err := api.PostMessage(channel, slack.MsgOptionText(message, false))
+
+	if err != nil {
+		return "", err
+	}
+	return threadTimestamp, nil
+}
+
+func SlackNewReply(api *slack.Client, channel, threadTimestamp, message string) (string, error) {
+	_, msgTimestamp, err := api.PostMessage(channel, slack.MsgOptionTS(threadTimestamp), slack.MsgOptionText(message, false))
+
+	if err != nil {
+		return "", err
+	}
+	return msgTimestamp, nil
+}
+
+func SlackUpdateMessage(api *slack.Client, channel, msgTimestamp, message string) (string, error) {
+	_, _, _, err := api.UpdateMessage(channel, msgTimestamp, slack.MsgOptionText(message, false))
+
+	if err != nil {
+		return "", err
+	}
+	return msgTimestamp, nil
+}
+
+// utils
+type TokenFileConfig struct {
+	SlackToken        string              `json:"slack-token"`
+	AppToken          string              `json:"app-token"`
+	Authorization     AuthorizationConfig `json:"authorization"`
+	DangerousPatterns []string            `json:"dangerous-patterns"`
+}
+
+// AuthorizationConfig gates who may invoke slack-shell and what they may
+// run. Empty AllowedUsers/AllowedChannels mean "no restriction"; this keeps
+// existing config files working without an authorization section.
+type AuthorizationConfig struct {
+	AllowedUsers     []string          `json:"allowed-users"`
+	AllowedChannels  []string          `json:"allowed-channels"`
+	CommandAllowlist map[string]string `json:"command-allowlist"`
+	CommandDenylist  map[string]string `json:"command-denylist"`
+}
+
+// Allow reports whether user may run command in channel, along with a
+// human-readable denial reason when it may not.
+func (a AuthorizationConfig) Allow(user, channel, command string) (bool, string) {
+	if user == "" {
+		return false, "unable to determine invoking user"
+	}
+
+	if len(a.AllowedUsers) > 0 && !contains(a.AllowedUsers, user) {
+		return false, fmt.Sprintf("user %s is not in allowed-users", user)
+	}
+
+	if len(a.AllowedChannels) > 0 && !contains(a.AllowedChannels, channel) {
+		return false, fmt.Sprintf("channel %s is not in allowed-channels", channel)
+	}
+
+	if pattern, ok := a.CommandDenylist[user]; ok {
+		matched, err := regexp.MatchString(pattern, command)
+		if err != nil {
+			return false, fmt.Sprintf("invalid command-denylist pattern for %s: %s", user, err)
+		}
+		if matched {
+			return false, fmt.Sprintf("command matches command-denylist for %s", user)
+		}
+	}
+
+	if pattern, ok := a.CommandAllowlist[user]; ok {
+		matched, err := regexp.MatchString(pattern, command)
+		if err != nil {
+			return false, fmt.Sprintf("invalid command-allowlist pattern for %s: %s", user, err)
+		}
+		if !matched {
+			return false, fmt.Sprintf("command does not match command-allowlist for %s", user)
+		}
+	}
+
+	return true, ""
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLog records an authorization decision with a timestamp, the
+// invoking user, and the command for later review.
+func AuditLog(approved bool, user, channel, command, reason string) {
+	decision := "approved"
+	if !approved {
+		decision = "denied"
+	}
+	if reason != "" {
+		Infof("[audit] %s %s: user=%s channel=%s command=%q reason=%q",
+			time.Now().Format(time.RFC3339), decision, user, channel, command, reason)
+		return
+	}
+	Infof("[audit] %s %s: user=%s channel=%s command=%q",
+		time.Now().Format(time.RFC3339), decision, user, channel, command)
+}
+
+func LoadConfigFromFile(filepath string) (*TokenFileConfig, error) {
+	jsonFile, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading config file from %q: %s", filepath, err)
+	}
+
+	var conf TokenFileConfig
+	err = json.Unmarshal(jsonFile, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling config file: %s", err)
+	}
+
+	return &conf, nil
+}
+
+func GetRedacted(unRedactedToken string) string {
+	// redact any letter & digit
+	pattern := regexp.MustCompile(`[A-Za-z0-9]`)
+	return pattern.ReplaceAllString(unRedactedToken, "X")
+}
+
+func ParseMessage(message string) (string, string, error) {
+	// jorgectf: this is a command
+
+	// https://api.slack.com/reference/surfaces/formatting#escaping
+	message = strings.ReplaceAll(message, "&amp;", "&")
+	message = strings.ReplaceAll(message, "&lt;", "<")
+	message = strings.ReplaceAll(message, "&gt;", ">")
+
+	// copy-pasting from slack -> jorgectf: this%C2%A0is%C2%A0a%C2%A0command
+	urlEncodedMessage := url.QueryEscape(message)
+	if strings.Contains(urlEncodedMessage, "%C2%A0") {
+		message, _ = url.QueryUnescape(
+			strings.ReplaceAll(urlEncodedMessage, "%C2%A0", "+"),
+		)
+	}
+
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return "", "", fmt.Errorf("Empty command received. %s", message)
+	}
+
+	return WrapShellPayload(message), message, nil
+}
+
+// WrapShellPayload smuggles message through a base64-encoded pipeline so
+// that shell metacharacters in it are never interpreted by the
+// intermediate exec.Command argument splitting. See
+// http://www.jackson-t.ca/runtime-exec-payloads.html
+func WrapShellPayload(message string) string {
+	command := b64.StdEncoding.EncodeToString([]byte(message))
+	return fmt.Sprintf("bash -c {echo,%s}|{base64,-d}|bash", command)
+}
+
+// CompileDangerousPatterns compiles the configured dangerous-patterns
+// regexes once at startup.
+func CompileDangerousPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dangerous-patterns entry %q: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func isDangerous(patterns []*regexp.Regexp, command string) bool {
+	for _, re := range patterns {
+		if re.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingConfirmations maps a confirmation ID to the channel awaiting its
+// Approve/Cancel decision, populated via the block_actions interaction
+// handled in handleInteraction.
+var pendingConfirmations = struct {
+	sync.Mutex
+	m map[string]chan bool
+}{m: make(map[string]chan bool)}
+
+func awaitConfirmation(id string) chan bool {
+	ch := make(chan bool, 1)
+	pendingConfirmations.Lock()
+	pendingConfirmations.m[id] = ch
+	pendingConfirmations.Unlock()
+	return ch
+}
+
+func forgetConfirmation(id string) {
+	pendingConfirmations.Lock()
+	delete(pendingConfirmations.m, id)
+	pendingConfirmations.Unlock()
+}
+
+func resolveConfirmation(id string, approved bool) {
+	pendingConfirmations.Lock()
+	ch, ok := pendingConfirmations.m[id]
+	pendingConfirmations.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- approved:
+	default:
+	}
+}
+
+// ConfirmDangerousCommand posts an Approve/Cancel prompt for a command that
+// matched dangerous-patterns and blocks until someone clicks Approve or
+// Cancel or the confirmation times out. The click is not checked against
+// the invoking user: any user who can see the prompt resolves it.
+func ConfirmDangerousCommand(api *slack.Client, channel, user, readableCommand, command string) (bool, error) {
+	confirmationID := fmt.Sprintf("confirm-%d", time.Now().UnixNano())
+	resultCh := awaitConfirmation(confirmationID)
+	defer forgetConfirmation(confirmationID)
+
+	_, _, err := api.PostMessage(channel, slack.MsgOptionBlocks(
+		slack.NewSectionBlock(
+			slack.NewTextBlockObject(
+				slack.MarkdownType,
+				fmt.Sprintf(
+					"<@%s> asked me to run a command matching `dangerous-patterns`:\n```%s```\nBase64 payload: `%s`",
+					user, readableCommand, b64.StdEncoding.EncodeToString([]byte(command)),
+				),
+				false, false,
+			),
+			nil, nil,
+		),
+		slack.NewActionBlock(
+			confirmationID,
+			slack.NewButtonBlockElement("approve", confirmationID,
+				slack.NewTextBlockObject(slack.PlainTextType, "Approve", false, false),
+			).WithStyle(slack.StylePrimary),
+			slack.NewButtonBlockElement("cancel", confirmationID,
+				slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+			).WithStyle(slack.StyleDanger),
+		),
+	))
+	if err != nil {
+		return false, err
+	}
+
+	select {
+	case approved := <-resultCh:
+		return approved, nil
+	case <-time.After(5 * time.Minute):
+		return false, fmt.Errorf("confirmation for %q timed out", readableCommand)
+	}
+}
+
+// handleInteraction resolves the pending confirmation named by the clicked
+// button's block action value, approving or cancelling the command that is
+// blocked on it.
+func handleInteraction(callback slack.InteractionCallback) {
+	if callback.Type != slack.InteractionTypeBlockActions {
+		return
+	}
+	for _, action := range callback.ActionCallback.BlockActions {
+		resolveConfirmation(action.Value, action.ActionID == "approve")
+	}
+}
+
+// CommandHandler lets additional command backends be registered alongside
+// the default shell execution path. Handlers are tried in registration
+// order and the first Match wins, so a catch-all handler (ShellHandler)
+// must be registered last.
+type CommandHandler interface {
+	// Match reports whether this handler should run for the given
+	// (already parsed, whitespace-trimmed) command text.
+	Match(text string) bool
+	// Execute runs the command. reply posts a threaded Slack message;
+	// it may be called zero or more times.
+	Execute(ctx context.Context, args []string, reply func(string)) error
+}
+
+func matchHandler(handlers []CommandHandler, text string) CommandHandler {
+	for _, h := range handlers {
+		if h.Match(text) {
+			return h
+		}
+	}
+	return nil
+}
+
+type execStateKey struct{}
+
+// execState carries the per-invocation Slack context a CommandHandler
+// needs (the channel to reply in, the thread to reply into, ...) without
+// widening the CommandHandler interface itself.
+type execState struct {
+	API             *slack.Client
+	Channel         string
+	ThreadTimestamp string
+	Wait            time.Duration
+	ForceUpload     bool
+	IncludeRegex    *regexp.Regexp
+	ExcludeRegex    *regexp.Regexp
+	// RawCommand is the parsed command exactly as received, unlike the
+	// whitespace-collapsing []string args CommandHandler.Execute gets;
+	// ShellHandler uses it so repeated/newline whitespace in a command
+	// survives into the payload it execs.
+	RawCommand string
+}
+
+func withExecState(ctx context.Context, st execState) context.Context {
+	return context.WithValue(ctx, execStateKey{}, st)
+}
+
+func execStateFrom(ctx context.Context) execState {
+	return ctx.Value(execStateKey{}).(execState)
+}
+
+// matchesLineFilters reports whether an output line should be forwarded to
+// Slack given st's IncludeRegex/ExcludeRegex, either of which may be nil.
+func (st execState) matchesLineFilters(line []byte) bool {
+	if st.IncludeRegex != nil && !st.IncludeRegex.Match(line) {
+		return false
+	}
+	if st.ExcludeRegex != nil && st.ExcludeRegex.Match(line) {
+		return false
+	}
+	return true
+}
+
+// HelpHandler lists the available built-in commands.
+type HelpHandler struct{}
+
+func (h *HelpHandler) Match(text string) bool {
+	return text == "help"
+}
+
+func (h *HelpHandler) Execute(ctx context.Context, args []string, reply func(string)) error {
+	reply("Built-in commands: `help`, `ps`, `kill <jobID>`, `cd <dir>`. Anything else is run as a shell command.")
+	return nil
+}
+
+// PsHandler lists the shell jobs currently running for the invoking channel.
+type PsHandler struct{}
+
+func (h *PsHandler) Match(text string) bool {
+	return text == "ps"
+}
+
+func (h *PsHandler) Execute(ctx context.Context, args []string, reply func(string)) error {
+	st := execStateFrom(ctx)
+	jobs := listJobs(st.Channel)
+	if len(jobs) == 0 {
+		reply("No running jobs in this channel.")
+		return nil
+	}
+
+	var lines strings.Builder
+	for _, job := range jobs {
+		fmt.Fprintf(&lines, "[%d] %s\n", job.ID, job.Command)
+	}
+	reply(lines.String())
+	return nil
+}
+
+// KillHandler cancels a previously started job by ID.
+type KillHandler struct{}
+
+func (h *KillHandler) Match(text string) bool {
+	return text == "kill" || strings.HasPrefix(text, "kill ")
+}
+
+func (h *KillHandler) Execute(ctx context.Context, args []string, reply func(string)) error {
+	if len(args) != 2 {
+		reply("Usage: kill <jobID>")
+		return nil
+	}
+
+	jobID, err := strconv.Atoi(args[1])
+	if err != nil {
+		reply(fmt.Sprintf("Invalid job ID %q", args[1]))
+		return nil
+	}
+
+	if !killJob(jobID) {
+		reply(fmt.Sprintf("No running job with ID %d", jobID))
+		return nil
+	}
+	reply(fmt.Sprintf("Job %d cancelled.", jobID))
+	return nil
+}
+
+// CdHandler sets the persistent working directory ShellHandler uses for
+// subsequent commands in the same channel.
+type CdHandler struct{}
+
+func (h *CdHandler) Match(text string) bool {
+	return text == "cd" || strings.HasPrefix(text, "cd ")
+}
+
+func (h *CdHandler) Execute(ctx context.Context, args []string, reply func(string)) error {
+	st := execStateFrom(ctx)
+
+	dir := ""
+	if len(args) > 1 {
+		dir = strings.Join(args[1:], " ")
+	}
+
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			reply(fmt.Sprintf("Cannot cd to %s: %s", dir, err))
+			return nil
+		}
+		if !info.IsDir() {
+			reply(fmt.Sprintf("Cannot cd to %s: not a directory", dir))
+			return nil
+		}
+	}
+
+	setWorkingDir(st.Channel, dir)
+	if dir == "" {
+		reply("Working directory reset to default.")
+	} else {
+		reply(fmt.Sprintf("Working directory set to %s", dir))
+	}
+	return nil
+}
+
+// ShellHandler wraps the original exec.Command behavior: it runs
+// execState's RawCommand (not args, whose whitespace-collapsing split
+// would corrupt multi-line or whitespace-sensitive commands) as a
+// base64-smuggled bash payload and streams the output back into the
+// invoking thread, either as chunked replies or, for large output, as file
+// uploads (see UploadCommandOutput). Output lines are filtered through
+// execState's IncludeRegex/ExcludeRegex, if set, before being buffered.
+type ShellHandler struct {
+	NoStdout        bool
+	NoStderr        bool
+	CharLimit       int
+	ForceUpload     bool
+	UploadThreshold int
+	IsDebug         bool
+}
+
+func (h *ShellHandler) Match(text string) bool {
+	return true
+}
+
+func (h *ShellHandler) Execute(ctx context.Context, args []string, reply func(string)) error {
+	st := execStateFrom(ctx)
+	readableCommand := st.RawCommand
+	command := WrapShellPayload(readableCommand)
+
+	var toSend string
+	var stdoutBuf string
+	var stderrBuf string
+
+	splitCommand := strings.Split(command, " ")
+	cmd := exec.CommandContext(ctx, splitCommand[0], splitCommand[1:]...)
+	if dir := getWorkingDir(st.Channel); dir != "" {
+		cmd.Dir = dir
+	}
+
+	// Sync stdout and stderr (Not to mess up the order)
+	stdoutFinished := true
+	if !h.NoStdout {
+		stdout, err := cmd.StdoutPipe()
+		stdoutFinished = false
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			buf := bufio.NewReader(stdout)
+			for {
+				line, _, err := buf.ReadLine()
+				if err != nil {
+					break
+				}
+				if !st.matchesLineFilters(line) {
+					continue
+				}
+				toSend += string(line) + "\n"
+				stdoutBuf += string(line) + "\n"
+				if h.IsDebug {
+					fmt.Println(len(line))
+				}
+			}
+			stdoutFinished = true
+		}()
+	}
+
+	stderrFinished := true
+	if !h.NoStderr {
+		stderr, err := cmd.StderrPipe()
+		stderrFinished = false
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			buf := bufio.NewReader(stderr)
+			for {
+				line, _, err := buf.ReadLine()
+				if err != nil {
+					break
+				}
+				if !st.matchesLineFilters(line) {
+					continue
+				}
+				toSend += string(line) + "\n"
+				stderrBuf += string(line) + "\n"
+				if h.IsDebug {
+					fmt.Println(len(line))
+				}
+			}
+			stderrFinished = true
+		}()
+	}
+
+	// must cmd.Start() *after* Std(out|err)Pipe()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// first reply
+	msgTimestamp, err := SlackNewReply(st.API, st.Channel, st.ThreadTimestamp, "Output is coming :P")
+	if err != nil {
+		return err
+	}
+	time.Sleep(st.Wait)
+
+	// Keep waiting, re-checking the threshold every tick, as long as the
+	// command is still producing output below it: a chatty command can
+	// cross UploadThreshold several --wait ticks in, not just on the
+	// first one.
+	for !(h.ForceUpload || st.ForceUpload || len(toSend) > h.UploadThreshold) && !(stdoutFinished && stderrFinished) {
+		time.Sleep(st.Wait)
+	}
+
+	// Large or explicitly-flagged output skips the chunked replies below
+	// and is posted as file attachments once the command finishes,
+	// falling back to chunked replies if the upload fails.
+	if h.ForceUpload || st.ForceUpload || len(toSend) > h.UploadThreshold {
+		for !(stdoutFinished && stderrFinished) {
+			time.Sleep(st.Wait)
+		}
+
+		err = UploadCommandOutput(st.API, st.Channel, st.ThreadTimestamp, readableCommand, stdoutBuf, stderrBuf)
+		if err == nil {
+			Infof("%s finished (uploaded)", readableCommand)
+			return nil
+		}
+
+		Infof("file upload failed for %q, falling back to chunked replies: %s", readableCommand, err)
+	}
+
+	index := 0
+	needsNewReply := false
+	hasFinished := false
+	for {
+		now := toSend // avoid goroutines pollution through execution
+		if len(now) > h.CharLimit*(index+1) && !needsNewReply {
+			_, err = SlackUpdateMessage(st.API,
+				st.Channel,
+				msgTimestamp,
+				toSend[h.CharLimit*index:h.CharLimit*(index+1)],
+			)
+			index += 1
+			needsNewReply = true
+			if err != nil {
+				return err
+			}
+		} else {
+			if needsNewReply {
+				if len(now) > h.CharLimit*(index+1) {
+					msgTimestamp, err = SlackNewReply(st.API,
+						st.Channel,
+						st.ThreadTimestamp,
+						now[h.CharLimit*index:h.CharLimit*(index+1)],
+					)
+					index += 1
+				} else {
+					msgTimestamp, err = SlackNewReply(st.API,
+						st.Channel,
+						st.ThreadTimestamp,
+						now[h.CharLimit*index:len(now)-1],
+					)
+					needsNewReply = false
+				}
+				if err != nil {
+					return err
+				}
+			} else {
+				_, err = SlackUpdateMessage(st.API,
+					st.Channel,
+					msgTimestamp,
+					now[h.CharLimit*index:len(now)-1],
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// make sure loop is redone and all the output is sent
+		if hasFinished && !needsNewReply {
+			Infof("%s finished", readableCommand)
+			break
+		}
+		if stdoutFinished && stderrFinished {
+			hasFinished = true
+		}
+
+		time.Sleep(st.Wait)
+	}
+
+	return nil
+}
+
+// Job tracks a running ShellHandler invocation so it can be listed (`ps`)
+// or cancelled (`kill <jobID>`) from the invoking channel.
+type Job struct {
+	ID      int
+	Channel string
+	Command string
+	cancel  context.CancelFunc
+}
+
+var jobs = struct {
+	sync.Mutex
+	nextID int
+	byID   map[int]*Job
+}{byID: make(map[int]*Job)}
+
+func registerJob(channel, command string, cancel context.CancelFunc) int {
+	jobs.Lock()
+	defer jobs.Unlock()
+	jobs.nextID++
+	id := jobs.nextID
+	jobs.byID[id] = &Job{ID: id, Channel: channel, Command: command, cancel: cancel}
+	return id
+}
+
+func unregisterJob(id int) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	delete(jobs.byID, id)
+}
+
+func listJobs(channel string) []*Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	var result []*Job
+	for _, job := range jobs.byID {
+		if job.Channel == channel {
+			result = append(result, job)
+		}
+	}
+	return result
+}
+
+func killJob(id int) bool {
+	jobs.Lock()
+	job, ok := jobs.byID[id]
+	jobs.Unlock()
+	if !ok {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// workingDirs holds the `cd`-assigned working directory per channel, used
+// by ShellHandler for subsequent commands in that channel.
+var workingDirs = struct {
+	sync.Mutex
+	byChannel map[string]string
+}{byChannel: make(map[string]string)}
+
+func getWorkingDir(channel string) string {
+	workingDirs.Lock()
+	defer workingDirs.Unlock()
+	return workingDirs.byChannel[channel]
+}
+
+func setWorkingDir(channel, dir string) {
+	workingDirs.Lock()
+	defer workingDirs.Unlock()
+	workingDirs.byChannel[channel] = dir
+}
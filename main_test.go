@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAuthorizationConfigAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    AuthorizationConfig
+		user    string
+		channel string
+		command string
+		allowed bool
+	}{
+		{
+			name:    "empty config allows anyone",
+			conf:    AuthorizationConfig{},
+			user:    "U1",
+			channel: "C1",
+			command: "ls",
+			allowed: true,
+		},
+		{
+			name:    "no user denied",
+			conf:    AuthorizationConfig{},
+			user:    "",
+			channel: "C1",
+			command: "ls",
+			allowed: false,
+		},
+		{
+			name:    "user not in allowlist",
+			conf:    AuthorizationConfig{AllowedUsers: []string{"U1"}},
+			user:    "U2",
+			channel: "C1",
+			command: "ls",
+			allowed: false,
+		},
+		{
+			name:    "channel not in allowlist",
+			conf:    AuthorizationConfig{AllowedChannels: []string{"C1"}},
+			user:    "U1",
+			channel: "C2",
+			command: "ls",
+			allowed: false,
+		},
+		{
+			name:    "command matches denylist",
+			conf:    AuthorizationConfig{CommandDenylist: map[string]string{"U1": "^rm"}},
+			user:    "U1",
+			channel: "C1",
+			command: "rm -rf /",
+			allowed: false,
+		},
+		{
+			name:    "command does not match allowlist",
+			conf:    AuthorizationConfig{CommandAllowlist: map[string]string{"U1": "^ls"}},
+			user:    "U1",
+			channel: "C1",
+			command: "rm -rf /",
+			allowed: false,
+		},
+		{
+			name:    "command matches allowlist",
+			conf:    AuthorizationConfig{CommandAllowlist: map[string]string{"U1": "^ls"}},
+			user:    "U1",
+			channel: "C1",
+			command: "ls -la",
+			allowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, reason := tt.conf.Allow(tt.user, tt.channel, tt.command)
+			if allowed != tt.allowed {
+				t.Fatalf("Allow() = %v (reason %q), want %v", allowed, reason, tt.allowed)
+			}
+			if !allowed && reason == "" {
+				t.Fatalf("Allow() denied with no reason")
+			}
+		})
+	}
+}
+
+func TestStripUploadSuffix(t *testing.T) {
+	tests := []struct {
+		in         string
+		wantText   string
+		wantUpload bool
+	}{
+		{"ls -la", "ls -la", false},
+		{"ls -la > file", "ls -la", true},
+		{"ls -la  >file  ", "ls -la", true},
+	}
+
+	for _, tt := range tests {
+		text, upload := stripUploadSuffix(tt.in)
+		if text != tt.wantText || upload != tt.wantUpload {
+			t.Errorf("stripUploadSuffix(%q) = (%q, %v), want (%q, %v)",
+				tt.in, text, upload, tt.wantText, tt.wantUpload)
+		}
+	}
+}
+
+func TestStripLineFilterSuffixes(t *testing.T) {
+	tests := []struct {
+		in          string
+		wantText    string
+		wantInclude string
+		wantExclude string
+	}{
+		{"tail -f log", "tail -f log", "", ""},
+		{"tail -f log | grep-in /ERROR/", "tail -f log", "ERROR", ""},
+		{"tail -f log | grep-out /DEBUG/", "tail -f log", "", "DEBUG"},
+		{
+			"tail -f log | grep-in /ERROR/ | grep-out /DEBUG/",
+			"tail -f log",
+			"ERROR",
+			"DEBUG",
+		},
+		{
+			"tail -f log | grep-out /DEBUG/ | grep-in /ERROR/",
+			"tail -f log",
+			"ERROR",
+			"DEBUG",
+		},
+	}
+
+	for _, tt := range tests {
+		text, include, exclude := stripLineFilterSuffixes(tt.in)
+		if text != tt.wantText || include != tt.wantInclude || exclude != tt.wantExclude {
+			t.Errorf("stripLineFilterSuffixes(%q) = (%q, %q, %q), want (%q, %q, %q)",
+				tt.in, text, include, exclude, tt.wantText, tt.wantInclude, tt.wantExclude)
+		}
+	}
+}
+
+func TestWrapShellPayload(t *testing.T) {
+	got := WrapShellPayload("echo hi")
+	want := "bash -c {echo,ZWNobyBoaQ==}|{base64,-d}|bash"
+	if got != want {
+		t.Errorf("WrapShellPayload() = %q, want %q", got, want)
+	}
+}
+
+func TestJobRegistry(t *testing.T) {
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id := registerJob("C-test-job-registry", "sleep 100", cancel)
+
+	found := false
+	for _, job := range listJobs("C-test-job-registry") {
+		if job.ID == id {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("listJobs() did not contain registered job %d", id)
+	}
+
+	// killJob cancels the job's context but, like production (where
+	// unregisterJob runs via defer once ShellHandler.Execute actually
+	// returns), leaves it registered until unregisterJob is called.
+	if !killJob(id) {
+		t.Fatalf("killJob(%d) = false, want true", id)
+	}
+
+	unregisterJob(id)
+	if killJob(id) {
+		t.Fatalf("killJob(%d) after unregisterJob = true, want false", id)
+	}
+}